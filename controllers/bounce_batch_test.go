@@ -0,0 +1,181 @@
+/*
+ * bounce_batch_test.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// bounceBatchTestFixture builds a status with one process per
+// (processGroupID, faultDomain) pair, plus a cluster configured with the
+// given BounceBatch options, and returns the status' process addresses in
+// the same order so tests don't need to hand-construct ProcessAddress keys.
+func bounceBatchTestFixture(batch *fdbv1beta2.BounceBatch, groups []struct {
+	processGroupID string
+	faultDomain    string
+}) (*fdbv1beta2.FoundationDBCluster, *fdbv1beta2.FoundationDBStatus, []fdbv1beta2.ProcessAddress) {
+	processes := make(map[string]fdbv1beta2.FoundationDBStatusProcessInfo, len(groups))
+	addresses := make([]fdbv1beta2.ProcessAddress, 0, len(groups))
+	for _, group := range groups {
+		address := fdbv1beta2.ProcessAddress{IPAddress: group.processGroupID}
+		processes[group.processGroupID] = fdbv1beta2.FoundationDBStatusProcessInfo{
+			Address:      address,
+			ProcessClass: fdbv1beta2.ProcessClassStorage,
+			Locality: map[string]string{
+				fdbv1beta2.FDBLocalityInstanceIDKey: group.processGroupID,
+				fdbv1beta2.FDBLocalityZoneIDKey:      group.faultDomain,
+			},
+		}
+		addresses = append(addresses, address)
+	}
+
+	cluster := &fdbv1beta2.FoundationDBCluster{}
+	cluster.Spec.AutomationOptions.BounceBatch = batch
+	status := &fdbv1beta2.FoundationDBStatus{
+		Cluster: fdbv1beta2.FoundationDBStatusClusterInfo{
+			Processes: processes,
+		},
+	}
+
+	return cluster, status, addresses
+}
+
+func TestSelectNextBounceBatchResumesAfterRestart(t *testing.T) {
+	batch := &fdbv1beta2.BounceBatch{MaxProcesses: 10, Interval: metav1.Duration{Duration: time.Minute}}
+	cluster, status, addresses := bounceBatchTestFixture(batch, []struct {
+		processGroupID string
+		faultDomain    string
+	}{
+		{"storage-1", "zone-1"},
+		{"storage-2", "zone-2"},
+	})
+
+	// Simulate a reconciler restart that resumes with progress already
+	// recorded for storage-1, from well before the batch interval.
+	startedAt := time.Now().Add(-time.Hour).Unix()
+	cluster.Status.BounceProgress = &fdbv1beta2.BounceProgress{
+		BatchIndex:             0,
+		BouncedProcessGroupIDs: []string{"storage-1"},
+		StartedAt:              startedAt,
+	}
+
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	batchAddresses, batchProcessGroupIDs, _, req := selectNextBounceBatch(logr.Discard(), r, cluster, status, addresses)
+	if req != nil {
+		t.Fatalf("expected no requeue, got %+v", req)
+	}
+
+	if len(batchAddresses) != 1 || batchProcessGroupIDs[0] != "storage-2" {
+		t.Fatalf("expected only storage-2 to resume, got process groups %v", batchProcessGroupIDs)
+	}
+}
+
+func TestSelectNextBounceBatchEnforcesFaultDomainLimit(t *testing.T) {
+	batch := &fdbv1beta2.BounceBatch{MaxProcesses: 10, MaxPerFaultDomain: 1}
+	cluster, status, addresses := bounceBatchTestFixture(batch, []struct {
+		processGroupID string
+		faultDomain    string
+	}{
+		{"storage-1", "zone-1"},
+		{"storage-2", "zone-1"},
+		{"storage-3", "zone-2"},
+	})
+
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	batchAddresses, batchProcessGroupIDs, moreBatches, req := selectNextBounceBatch(logr.Discard(), r, cluster, status, addresses)
+	if req != nil {
+		t.Fatalf("expected no requeue, got %+v", req)
+	}
+
+	if len(batchAddresses) != 2 {
+		t.Fatalf("expected one process group from each fault domain (2 total), got %d: %v", len(batchAddresses), batchProcessGroupIDs)
+	}
+
+	seenZone1 := 0
+	for _, id := range batchProcessGroupIDs {
+		if id == "storage-1" || id == "storage-2" {
+			seenZone1++
+		}
+	}
+	if seenZone1 != 1 {
+		t.Errorf("expected exactly one process group from zone-1 in the batch, got %d", seenZone1)
+	}
+
+	if !moreBatches {
+		t.Errorf("expected moreBatches to be true since the zone-1 limit held back a candidate")
+	}
+}
+
+func TestSelectNextBounceBatchSkipsUnresolvedAddressesWithoutPoisoningOthers(t *testing.T) {
+	batch := &fdbv1beta2.BounceBatch{MaxProcesses: 10}
+	cluster, status, addresses := bounceBatchTestFixture(batch, []struct {
+		processGroupID string
+		faultDomain    string
+	}{
+		{"storage-1", "zone-1"},
+	})
+
+	unresolved := fdbv1beta2.ProcessAddress{IPAddress: "unresolved"}
+	addresses = append(addresses, unresolved)
+
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	batchAddresses, batchProcessGroupIDs, _, req := selectNextBounceBatch(logr.Discard(), r, cluster, status, addresses)
+	if req != nil {
+		t.Fatalf("expected no requeue, got %+v", req)
+	}
+
+	if len(batchAddresses) != 1 || batchProcessGroupIDs[0] != "storage-1" {
+		t.Fatalf("expected the resolvable address to still be batched on its own, got %v", batchProcessGroupIDs)
+	}
+}
+
+func TestSelectNextBounceBatchCapsConcurrentUnavailableByRole(t *testing.T) {
+	batch := &fdbv1beta2.BounceBatch{
+		MaxProcesses:                  10,
+		MaxConcurrentUnavailableByRole: map[string]int{string(fdbv1beta2.ProcessClassStorage): 1},
+	}
+	cluster, status, addresses := bounceBatchTestFixture(batch, []struct {
+		processGroupID string
+		faultDomain    string
+	}{
+		{"storage-1", "zone-1"},
+		{"storage-2", "zone-2"},
+	})
+
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	batchAddresses, batchProcessGroupIDs, moreBatches, req := selectNextBounceBatch(logr.Discard(), r, cluster, status, addresses)
+	if req != nil {
+		t.Fatalf("expected no requeue, got %+v", req)
+	}
+
+	if len(batchAddresses) != 1 {
+		t.Fatalf("expected the storage role cap to admit only one process, got %d: %v", len(batchAddresses), batchProcessGroupIDs)
+	}
+	if !moreBatches {
+		t.Errorf("expected moreBatches to be true since the role cap held back a candidate")
+	}
+}
@@ -22,7 +22,10 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/FoundationDB/fdb-kubernetes-operator/internal/restarts"
@@ -30,6 +33,7 @@ import (
 	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
 	"github.com/FoundationDB/fdb-kubernetes-operator/internal"
 	"github.com/FoundationDB/fdb-kubernetes-operator/pkg/fdbadminclient"
+	"github.com/FoundationDB/fdb-kubernetes-operator/pkg/upgradeprecondition"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/utils/pointer"
@@ -46,13 +50,29 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 	}
 
 	logger := log.WithValues("namespace", cluster.Namespace, "cluster", cluster.Name, "reconciler", "bounceProcesses")
+
+	upgradeBlocked, err := checkUpgradeBlocked(ctx, logger, r, cluster)
+	if err != nil {
+		return &requeue{curError: err}
+	}
+
+	upgrading := !upgradeBlocked && cluster.Status.RunningVersion != cluster.Spec.Version
+	useLocks := cluster.ShouldUseLocks()
+	// preconditionsEnforced reports whether checkUpgradePreconditions will
+	// actually run later in this reconcile. It only runs when useLocks is set,
+	// since PendingUpgradeAcknowledged depends on the lock client; on a
+	// non-locking cluster the ad-hoc MinimumUptime/ConfigMapSynced checks below
+	// are the only thing enforcing those bounds during an upgrade, so they must
+	// not be skipped just because upgrading is true.
+	preconditionsEnforced := useLocks && upgrading
+
 	adminClient, err := r.getDatabaseClientProvider().GetAdminClient(cluster, r)
 	if err != nil {
 		return &requeue{curError: err}
 	}
 	defer adminClient.Close()
 
-	status, err := adminClient.GetStatus()
+	status, err := adminClient.GetStatusWithContext(ctx)
 	if err != nil {
 		return &requeue{curError: err}
 	}
@@ -62,7 +82,7 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 		return &requeue{curError: err}
 	}
 
-	addresses, req := getProcessesReadyForRestart(logger, cluster, addressMap)
+	addresses, req := getProcessesReadyForRestart(logger, r, cluster, addressMap, preconditionsEnforced)
 	if req != nil {
 		return req
 	}
@@ -71,7 +91,11 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 		return nil
 	}
 
-	if minimumUptime < float64(cluster.GetMinimumUptimeSecondsForBounce()) {
+	// While checkUpgradePreconditions will run later this reconcile, the
+	// MinimumUptime upgradeprecondition enforces this same bound, so we only
+	// need the ad-hoc gate here otherwise (non-upgrade bounces, and upgrades on
+	// a non-locking cluster where the precondition framework never runs).
+	if !preconditionsEnforced && minimumUptime < float64(cluster.GetMinimumUptimeSecondsForBounce()) {
 		r.Recorder.Event(cluster, corev1.EventTypeNormal, "NeedsBounce",
 			fmt.Sprintf("Spec require a bounce of some processes, but the cluster has only been up for %f seconds", minimumUptime))
 		cluster.Status.Generations.NeedsBounce = cluster.ObjectMeta.Generation
@@ -88,7 +112,6 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 	}
 
 	var lockClient fdbadminclient.LockClient
-	useLocks := cluster.ShouldUseLocks()
 	if useLocks {
 		lockClient, err = r.getLockClient(cluster)
 		if err != nil {
@@ -100,14 +123,25 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 		return &requeue{curError: err}
 	}
 
-	upgrading := cluster.Status.RunningVersion != cluster.Spec.Version
+	canary := cluster.Spec.AutomationOptions.CanaryUpgrade
+	canarying := useLocks && upgrading && canary != nil
 
+	var releaseProcessGroupIDs []string
 	if useLocks && upgrading {
-		processGroupIDs := make([]string, 0, len(cluster.Status.ProcessGroups))
-		for _, processGroup := range cluster.Status.ProcessGroups {
-			processGroupIDs = append(processGroupIDs, processGroup.ProcessGroupID)
+		releaseProcessGroups := cluster.Status.ProcessGroups
+		if canarying {
+			var req *requeue
+			releaseProcessGroups, req = canaryProcessGroupsToRelease(logger, r, cluster, status, canary, version)
+			if req != nil {
+				return req
+			}
+		}
+
+		releaseProcessGroupIDs = make([]string, 0, len(releaseProcessGroups))
+		for _, processGroup := range releaseProcessGroups {
+			releaseProcessGroupIDs = append(releaseProcessGroupIDs, processGroup.ProcessGroupID)
 		}
-		err = lockClient.AddPendingUpgrades(version, processGroupIDs)
+		err = lockClient.AddPendingUpgradesWithContext(ctx, version, releaseProcessGroupIDs)
 		if err != nil {
 			return &requeue{curError: err}
 		}
@@ -119,21 +153,71 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 	}
 
 	if useLocks && upgrading {
-		var req *requeue
-		addresses, req = getAddressesForUpgrade(logger, r, status, lockClient, cluster, version)
+		req := checkUpgradePreconditions(ctx, logger, r, cluster, status, lockClient, minimumUptime, version, releaseProcessGroupIDs)
 		if req != nil {
 			return req
 		}
+
+		var req2 *requeue
+		addresses, req2 = getAddressesForUpgrade(ctx, lockClient, status, version)
+		if req2 != nil {
+			return req2
+		}
 		if addresses == nil {
 			return &requeue{curError: fmt.Errorf("unknown error when getting addresses that are ready for upgrade")}
 		}
+
+		if canarying {
+			// Only bounce the process groups released this reconcile, so every
+			// process outside the canary subset is held back during the soak.
+			releasing := make(map[string]bool, len(releaseProcessGroupIDs))
+			for _, processGroupID := range releaseProcessGroupIDs {
+				releasing[processGroupID] = true
+			}
+			locality := processLocalityByAddress(status)
+			released := make([]fdbv1beta2.ProcessAddress, 0, len(addresses))
+			for _, address := range addresses {
+				if releasing[locality[address.String()].processGroupID] {
+					released = append(released, address)
+				}
+			}
+			addresses = released
+		}
+	}
+
+	var moreBatches bool
+	var batchProcessGroupIDs []string
+	batched := cluster.Spec.AutomationOptions.BounceBatch != nil
+	if batched {
+		var req3 *requeue
+		addresses, batchProcessGroupIDs, moreBatches, req3 = selectNextBounceBatch(logger, r, cluster, status, addresses)
+		if req3 != nil {
+			return req3
+		}
+		if len(addresses) == 0 {
+			return nil
+		}
 	}
 
 	logger.Info("Bouncing processes", "addresses", addresses, "upgrading", upgrading)
 	r.Recorder.Event(cluster, corev1.EventTypeNormal, "BouncingProcesses", fmt.Sprintf("Bouncing processes: %v", addresses))
-	err = adminClient.KillProcesses(addresses)
-	if err != nil {
-		return &requeue{curError: err}
+	req = killProcesses(ctx, logger, r, cluster, adminClient, addresses)
+	if req != nil {
+		return req
+	}
+
+	if batched {
+		// Only record a process group as bounced once KillProcessesWithContext has
+		// actually returned success; recording it earlier would permanently hide
+		// it from future batches if the kill failed or was cancelled.
+		recordBounceBatchProgress(cluster, batchProcessGroupIDs, moreBatches)
+		if err := r.updateOrApply(ctx, cluster); err != nil {
+			logger.Error(err, "Error updating cluster status")
+		}
+	}
+
+	if moreBatches {
+		return &requeue{message: "More bounce batches remain", delay: cluster.Spec.AutomationOptions.BounceBatch.Interval.Duration}
 	}
 
 	// If the cluster was upgraded we will requeue and let the update_status command set the correct version.
@@ -147,13 +231,291 @@ func (bounceProcesses) reconcile(ctx context.Context, r *FoundationDBClusterReco
 	return nil
 }
 
+// selectNextBounceBatch partitions addresses by fault domain and process
+// class using the locality data in the latest database status, and returns
+// only the next batch that should be killed this reconcile according to
+// Spec.AutomationOptions.BounceBatch, along with the process group IDs in
+// that batch. It does not record any process group as bounced itself — the
+// caller only calls recordBounceBatchProgress once KillProcessesWithContext
+// has actually succeeded, so a failed or cancelled kill never makes a process
+// group look bounced when it was not. The only change it makes to
+// cluster.Status.BounceProgress is clearing it once no candidates are left
+// to bounce. It refuses to put a process into a
+// batch while its fault domain already has an unavailable log process, or
+// while the cluster has an ongoing recovery, and it caps how many processes
+// of each role may be concurrently unavailable across the whole batch. The
+// third return value reports whether addresses outside the returned batch
+// still need to be bounced in a future reconcile.
+func selectNextBounceBatch(logger logr.Logger, r *FoundationDBClusterReconciler, cluster *fdbv1beta2.FoundationDBCluster, status *fdbv1beta2.FoundationDBStatus, addresses []fdbv1beta2.ProcessAddress) ([]fdbv1beta2.ProcessAddress, []string, bool, *requeue) {
+	batch := cluster.Spec.AutomationOptions.BounceBatch
+
+	progress := cluster.Status.BounceProgress
+	if progress != nil {
+		if wait := batch.Interval.Duration - time.Since(time.Unix(progress.StartedAt, 0)); wait > 0 {
+			return nil, nil, true, &requeue{message: "Waiting for the minimum interval between bounce batches", delay: wait}
+		}
+	}
+
+	if reason := activeRecovery(status); reason != "" {
+		logger.Info("Deferring next bounce batch", "reason", reason)
+		r.Recorder.Event(cluster, corev1.EventTypeNormal, "BounceBatchDeferred", reason)
+		return nil, nil, true, &requeue{message: reason, delayedRequeue: true}
+	}
+
+	alreadyBounced := make(map[string]bool)
+	if progress != nil {
+		for _, processGroupID := range progress.BouncedProcessGroupIDs {
+			alreadyBounced[processGroupID] = true
+		}
+	}
+
+	locality := processLocalityByAddress(status)
+	badZones := zonesWithUnavailableLog(status)
+	unavailableByRole := unavailableCountsByRole(status)
+
+	var unresolved []string
+	candidates := make([]fdbv1beta2.ProcessAddress, 0, len(addresses))
+	for _, address := range addresses {
+		info, ok := locality[address.String()]
+		if !ok {
+			unresolved = append(unresolved, address.String())
+			continue
+		}
+		if alreadyBounced[info.processGroupID] {
+			continue
+		}
+		candidates = append(candidates, address)
+	}
+
+	if len(unresolved) > 0 {
+		logger.Info("Could not resolve locality for addresses, deferring them to a later batch", "addresses", unresolved)
+	}
+
+	if len(candidates) == 0 {
+		if progress != nil {
+			cluster.Status.BounceProgress = nil
+		}
+		return nil, nil, len(unresolved) > 0, nil
+	}
+
+	perFaultDomain := make(map[string]int)
+	plannedUnavailableByRole := make(map[string]int)
+	batchAddresses := make([]fdbv1beta2.ProcessAddress, 0, batch.MaxProcesses)
+	batchProcessGroupIDs := make([]string, 0, batch.MaxProcesses)
+
+	for _, address := range candidates {
+		if batch.MaxProcesses > 0 && len(batchAddresses) >= batch.MaxProcesses {
+			break
+		}
+
+		info := locality[address.String()]
+		if batch.MaxPerFaultDomain > 0 && perFaultDomain[info.faultDomain] >= batch.MaxPerFaultDomain {
+			continue
+		}
+
+		if badZones[info.faultDomain] {
+			logger.Info("Skipping process group, its fault domain already has an unavailable log process", "processGroupID", info.processGroupID, "faultDomain", info.faultDomain)
+			continue
+		}
+
+		if maxUnavailable, ok := batch.MaxConcurrentUnavailableByRole[info.role]; ok {
+			if unavailableByRole[info.role]+plannedUnavailableByRole[info.role] >= maxUnavailable {
+				continue
+			}
+		}
+
+		batchAddresses = append(batchAddresses, address)
+		batchProcessGroupIDs = append(batchProcessGroupIDs, info.processGroupID)
+		perFaultDomain[info.faultDomain]++
+		plannedUnavailableByRole[info.role]++
+	}
+
+	if len(batchAddresses) == 0 {
+		return nil, nil, true, &requeue{message: "Bounce batch safety limits leave no processes eligible this round", delayedRequeue: true}
+	}
+
+	return batchAddresses, batchProcessGroupIDs, len(batchAddresses) < len(candidates) || len(unresolved) > 0, nil
+}
+
+// recordBounceBatchProgress persists the process groups that were just
+// successfully bounced into cluster.Status.BounceProgress, advancing the
+// batch index. It must only be called after KillProcessesWithContext has
+// returned success for exactly these process groups. When moreBatches is
+// false the whole batch sequence is complete and the progress is cleared so
+// the next upgrade starts from a clean slate.
+func recordBounceBatchProgress(cluster *fdbv1beta2.FoundationDBCluster, batchProcessGroupIDs []string, moreBatches bool) {
+	if !moreBatches {
+		cluster.Status.BounceProgress = nil
+		return
+	}
+
+	progress := cluster.Status.BounceProgress
+	bounced := append([]string{}, batchProcessGroupIDs...)
+	batchIndex := 0
+	if progress != nil {
+		bounced = append(append([]string{}, progress.BouncedProcessGroupIDs...), batchProcessGroupIDs...)
+		batchIndex = progress.BatchIndex + 1
+	}
+
+	cluster.Status.BounceProgress = &fdbv1beta2.BounceProgress{
+		BatchIndex:             batchIndex,
+		BouncedProcessGroupIDs: bounced,
+		StartedAt:              time.Now().Unix(),
+	}
+}
+
+// processLocality holds the locality fields selectNextBounceBatch needs to
+// partition a batch.
+type processLocality struct {
+	processGroupID string
+	faultDomain    string
+	role           string
+}
+
+// processLocalityByAddress indexes the latest database status by process
+// address so batching can look up fault domain, role and process group ID
+// without re-scanning FoundationDBStatus.Cluster.Processes for every address.
+func processLocalityByAddress(status *fdbv1beta2.FoundationDBStatus) map[string]processLocality {
+	index := make(map[string]processLocality, len(status.Cluster.Processes))
+	for _, process := range status.Cluster.Processes {
+		index[process.Address.String()] = processLocality{
+			processGroupID: process.Locality[fdbv1beta2.FDBLocalityInstanceIDKey],
+			faultDomain:    process.Locality[fdbv1beta2.FDBLocalityZoneIDKey],
+			role:           string(process.ProcessClass),
+		}
+	}
+
+	return index
+}
+
+// zonesWithUnavailableLog returns the set of fault domains that currently
+// contain an unavailable log process, per the latest database status. A
+// batch must not add more load to a zone that is already missing a log
+// process.
+func zonesWithUnavailableLog(status *fdbv1beta2.FoundationDBStatus) map[string]bool {
+	zones := make(map[string]bool)
+	for _, process := range status.Cluster.Processes {
+		if process.ProcessClass == fdbv1beta2.ProcessClassLog && len(process.Messages) > 0 {
+			zones[process.Locality[fdbv1beta2.FDBLocalityZoneIDKey]] = true
+		}
+	}
+
+	return zones
+}
+
+// unavailableCountsByRole counts, per process role, how many processes are
+// currently unavailable according to the latest database status. This is the
+// baseline that Spec.AutomationOptions.BounceBatch.MaxConcurrentUnavailableByRole
+// is checked against before adding more processes of that role to a batch.
+func unavailableCountsByRole(status *fdbv1beta2.FoundationDBStatus) map[string]int {
+	counts := make(map[string]int)
+	for _, process := range status.Cluster.Processes {
+		if len(process.Messages) > 0 {
+			counts[string(process.ProcessClass)]++
+		}
+	}
+
+	return counts
+}
+
+// activeRecovery returns a non-empty reason if the cluster currently has a
+// recovery in progress, in which case it is not safe to start another bounce
+// batch.
+func activeRecovery(status *fdbv1beta2.FoundationDBStatus) string {
+	if status.Cluster.RecoveryState.Name != "" && status.Cluster.RecoveryState.Name != "fully_recovered" {
+		return fmt.Sprintf("cluster has an active recovery: %s", status.Cluster.RecoveryState.Name)
+	}
+
+	return ""
+}
+
+// killProcesses instructs the addresses to restart, cooperatively respecting
+// ctx cancellation (operator shutdown, cluster deletion) and
+// Spec.AutomationOptions.AbortBounce. Before issuing the kill it records the
+// addresses in cluster.Status.PendingRestarts and it clears them once the kill
+// succeeds, so a cancelled or failed kill leaves the addresses recorded there.
+// The bounceProcesses reconciler does not read PendingRestarts back: the next
+// reconcile selects the processes to bounce again from scratch.
+func killProcesses(ctx context.Context, logger logr.Logger, r *FoundationDBClusterReconciler, cluster *fdbv1beta2.FoundationDBCluster, adminClient fdbadminclient.AdminClient, addresses []fdbv1beta2.ProcessAddress) *requeue {
+	if pointer.BoolDeref(cluster.Spec.AutomationOptions.AbortBounce, false) {
+		logger.Info("Aborting in-flight bounce", "addresses", addresses)
+		r.Recorder.Event(cluster, corev1.EventTypeNormal, "BounceAborted", "AbortBounce is set, not instructing any processes to restart")
+		return &requeue{message: "Bounce aborted by AbortBounce", delayedRequeue: true}
+	}
+
+	cluster.Status.PendingRestarts = addresses
+	if err := r.updateOrApply(ctx, cluster); err != nil {
+		logger.Error(err, "Error updating cluster status")
+	}
+
+	err := adminClient.KillProcessesWithContext(ctx, addresses)
+	if err != nil {
+		if ctx.Err() != nil {
+			logger.Info("Bounce cancelled, resuming on the next reconcile", "addresses", addresses, "reason", ctx.Err())
+			return &requeue{message: "Bounce was cancelled", delayedRequeue: true}
+		}
+
+		return &requeue{curError: err}
+	}
+
+	cluster.Status.PendingRestarts = nil
+	if err := r.updateOrApply(ctx, cluster); err != nil {
+		logger.Error(err, "Error updating cluster status")
+	}
+
+	return nil
+}
+
+// checkUpgradeBlocked reports whether the version-change path should be
+// skipped this reconcile because the user has paused automatic upgrades via
+// Spec.AutomationOptions.AutoUpgradeEnabled or pinned the running version via
+// Spec.AutomationOptions.PreserveDowngradeOption. Pending upgrades that were
+// already registered with the lock client are left untouched, so clearing
+// either option lets the upgrade resume from where it left off. Non-upgrade
+// restarts are not affected and continue to be reconciled.
+func checkUpgradeBlocked(ctx context.Context, logger logr.Logger, r *FoundationDBClusterReconciler, cluster *fdbv1beta2.FoundationDBCluster) (bool, error) {
+	if cluster.Status.RunningVersion == cluster.Spec.Version {
+		return false, nil
+	}
+
+	autoUpgradeEnabled := pointer.BoolDeref(cluster.Spec.AutomationOptions.AutoUpgradeEnabled, true)
+	pinnedVersion := cluster.Spec.AutomationOptions.PreserveDowngradeOption
+	preservingDowngrade := pinnedVersion != "" && pinnedVersion == cluster.Status.RunningVersion
+
+	if autoUpgradeEnabled && !preservingDowngrade {
+		return false, nil
+	}
+
+	var message string
+	if preservingDowngrade {
+		message = fmt.Sprintf("Upgrade to %s is paused because PreserveDowngradeOption is set to the running version %s", cluster.Spec.Version, pinnedVersion)
+	} else {
+		message = fmt.Sprintf("Upgrade to %s is paused because AutoUpgradeEnabled is false", cluster.Spec.Version)
+	}
+
+	logger.Info(message)
+	r.Recorder.Event(cluster, corev1.EventTypeNormal, "UpgradeBlocked", message)
+
+	cluster.Status.Generations.NeedsBounce = cluster.ObjectMeta.Generation
+	if err := r.updateOrApply(ctx, cluster); err != nil {
+		logger.Error(err, "Error updating cluster status")
+	}
+
+	return true, nil
+}
+
 // getProcessesReadyForRestart returns a slice of process addresses that can be restarted. If addresses are missing or not all processes
-// have the latest configuration this method will return a requeue struct with more details.
-func getProcessesReadyForRestart(logger logr.Logger, cluster *fdbv1beta2.FoundationDBCluster, addressMap map[string][]fdbv1beta2.ProcessAddress) ([]fdbv1beta2.ProcessAddress, *requeue) {
+// have the latest configuration this method will return a requeue struct with more details. preconditionsEnforced reports whether
+// checkUpgradePreconditions will also run this reconcile, so the ad-hoc ConfigMapSynced gate below only has to cover the cases where
+// it won't (non-upgrade bounces, and upgrades on a cluster that isn't using locks).
+func getProcessesReadyForRestart(logger logr.Logger, r *FoundationDBClusterReconciler, cluster *fdbv1beta2.FoundationDBCluster, addressMap map[string][]fdbv1beta2.ProcessAddress, preconditionsEnforced bool) ([]fdbv1beta2.ProcessAddress, *requeue) {
 	processesToBounce := fdbv1beta2.FilterByConditions(cluster.Status.ProcessGroups, restarts.GetFilterConditions(cluster), true)
 	addresses := make([]fdbv1beta2.ProcessAddress, 0, len(processesToBounce))
 	allSynced := true
 	var missingAddress []string
+	var notYetAvailable []string
+
+	minReadySeconds := cluster.Spec.AutomationOptions.ProcessMinReadySeconds
 
 	for _, process := range processesToBounce {
 		processGroup := fdbv1beta2.FindProcessGroupByID(cluster.Status.ProcessGroups, process)
@@ -176,6 +538,12 @@ func getProcessesReadyForRestart(logger logr.Logger, cluster *fdbv1beta2.Foundat
 			continue
 		}
 
+		if minReadySeconds > 0 && !processGroupAvailableFor(processGroup, minReadySeconds) {
+			logger.Info("Process group has not been ready long enough to be bounced", "processGroupID", processGroup.ProcessGroupID, "processMinReadySeconds", minReadySeconds)
+			notYetAvailable = append(notYetAvailable, processGroup.ProcessGroupID)
+			continue
+		}
+
 		addresses = append(addresses, addressMap[process]...)
 
 		if processGroup.GetConditionTime(fdbv1beta2.IncorrectConfigMap) != nil {
@@ -188,7 +556,23 @@ func getProcessesReadyForRestart(logger logr.Logger, cluster *fdbv1beta2.Foundat
 		return nil, &requeue{curError: fmt.Errorf("could not find address for processes: %s", missingAddress), delayedRequeue: true}
 	}
 
-	if !allSynced {
+	// Process groups that are not yet available long enough are excluded from
+	// addresses above, not removed from the whole batch: a single recently
+	// restarted process group should not stall every other process group that
+	// is actually ready to be bounced. If every process group was held back,
+	// a delayed requeue is returned so they are retried later.
+	if len(notYetAvailable) > 0 {
+		message := fmt.Sprintf("%d process group(s) are not yet available long enough to bounce: %v", len(notYetAvailable), notYetAvailable)
+		r.Recorder.Event(cluster, corev1.EventTypeNormal, "NotAvailable", message)
+		if len(addresses) == 0 {
+			return nil, &requeue{message: message, delayedRequeue: true}
+		}
+	}
+
+	// While checkUpgradePreconditions will run later this reconcile, the
+	// ConfigMapSynced upgradeprecondition enforces this same requirement, so we
+	// only need the ad-hoc gate here otherwise.
+	if !preconditionsEnforced && !allSynced {
 		return nil, &requeue{message: "Waiting for config map to sync to all pods", delayedRequeue: true}
 	}
 
@@ -202,50 +586,293 @@ func getProcessesReadyForRestart(logger logr.Logger, cluster *fdbv1beta2.Foundat
 	// If we upgrade the cluster wait until all processes are ready for the restart. In the future we can adjust this
 	// to only be a requirement for version incompatible upgrades. In addition we probably only want to block for a
 	// certain threshold either as a percentage or as a fixed number (which could also be 0).
-	if cluster.IsBeingUpgraded() && counts.Total() != len(addresses) {
+	//
+	// Process groups excluded above for not yet meeting ProcessMinReadySeconds
+	// are subtracted from the expected count: they are deliberately held back
+	// rather than missing, so they must not make this look like processes
+	// failed to come up and block the processes that are actually ready.
+	expected := counts.Total() - len(notYetAvailable)
+	if cluster.IsBeingUpgraded() && expected != len(addresses) {
 		return nil, &requeue{
-			message:        fmt.Sprintf("expected %d processes, got %d processes ready to restart", counts.Total(), len(addresses)),
+			message:        fmt.Sprintf("expected %d processes, got %d processes ready to restart", expected, len(addresses)),
 			delayedRequeue: true}
 	}
 
 	return addresses, nil
 }
 
-// getAddressesForUpgrade checks that all processes in a cluster are ready to be
-// upgraded and returns the full list of addresses.
-func getAddressesForUpgrade(logger logr.Logger, r *FoundationDBClusterReconciler, databaseStatus *fdbv1beta2.FoundationDBStatus, lockClient fdbadminclient.LockClient, cluster *fdbv1beta2.FoundationDBCluster, version fdbv1beta2.Version) ([]fdbv1beta2.ProcessAddress, *requeue) {
-	pendingUpgrades, err := lockClient.GetPendingUpgrades(version)
+// processGroupAvailableFor reports whether a process group has been
+// continuously available, as tracked by the status reconciler in
+// ProcessGroupStatus.LastBecameReadyTime, for at least minReadySeconds. A
+// process group that has no recorded ready time yet (for example, one the
+// status reconciler has not observed as healthy since it last restarted) is
+// treated as not yet available.
+func processGroupAvailableFor(processGroup *fdbv1beta2.ProcessGroupStatus, minReadySeconds int) bool {
+	if processGroup.LastBecameReadyTime == nil {
+		return false
+	}
+
+	readySince := time.Since(processGroup.LastBecameReadyTime.Time)
+	return readySince >= time.Duration(minReadySeconds)*time.Second
+}
+
+// checkUpgradePreconditions runs the built-in upgrade preconditions together
+// with any cluster-supplied AutomationOptions.UpgradePreconditions, records a
+// consolidated event and status condition if any of them fail, and returns a
+// requeue listing every failing precondition. It returns nil once all
+// preconditions pass, allowing the upgrade to proceed. releaseProcessGroupIDs
+// is the set of process groups actually registered as pending this upgrade on
+// this reconcile (the canary subset during a canary, every process group
+// otherwise), so preconditions like PendingUpgradeAcknowledged don't demand
+// acknowledgment from process groups that were never registered in the first
+// place.
+func checkUpgradePreconditions(ctx context.Context, logger logr.Logger, r *FoundationDBClusterReconciler, cluster *fdbv1beta2.FoundationDBCluster, status *fdbv1beta2.FoundationDBStatus, lockClient fdbadminclient.LockClient, currentUptime float64, version fdbv1beta2.Version, releaseProcessGroupIDs []string) *requeue {
+	pendingUpgrades, err := lockClient.GetPendingUpgradesWithContext(ctx, version)
+	if err != nil {
+		return &requeue{curError: err}
+	}
+
+	preconditions := upgradeprecondition.Defaults(currentUptime, pendingUpgrades)
+	preconditions = append(preconditions, cluster.Spec.AutomationOptions.UpgradePreconditions...)
+
+	fromVersion, err := fdbv1beta2.ParseFdbVersion(cluster.Status.RunningVersion)
+	if err != nil {
+		return &requeue{curError: err}
+	}
+
+	releaseCtx := upgradeprecondition.ReleaseContext{
+		FromVersion:            fromVersion,
+		ToVersion:              version,
+		Cluster:                cluster,
+		Status:                 status,
+		ReleaseProcessGroupIDs: releaseProcessGroupIDs,
+	}
+
+	results := upgradeprecondition.RunAll(ctx, preconditions, releaseCtx)
+	if !upgradeprecondition.AnyFailed(results) {
+		cluster.Status.Generations.NeedsBounce = 0
+		cluster.Status.UpgradePreconditionsStatus = nil
+		return nil
+	}
+
+	message := upgradeprecondition.Summarize(results)
+	logger.Info("Deferring upgrade until all preconditions are met", "message", message)
+	r.Recorder.Event(cluster, corev1.EventTypeNormal, "UpgradePreconditionsFailed", message)
+
+	cluster.Status.Generations.NeedsBounce = cluster.ObjectMeta.Generation
+	cluster.Status.UpgradePreconditionsStatus = &fdbv1beta2.UpgradePreconditionsStatus{
+		FailedPreconditions: upgradeprecondition.FailedNames(results),
+		ObservedGeneration:  cluster.ObjectMeta.Generation,
+	}
+	if updateErr := r.updateOrApply(ctx, cluster); updateErr != nil {
+		logger.Error(updateErr, "Error updating cluster status")
+	}
+
+	return &requeue{message: message, delayedRequeue: true}
+}
+
+// canaryProcessGroupsToRelease determines which process groups should be
+// registered as pending an upgrade on this reconcile when a
+// Spec.AutomationOptions.CanaryUpgrade is configured. While the canary is
+// soaking it returns only the canary subset so that getAddressesForUpgrade
+// holds back every other process; once the soak duration has elapsed and
+// SuccessCriteria are satisfied it returns every process group so the
+// remaining addresses are released for upgrade.
+func canaryProcessGroupsToRelease(logger logr.Logger, r *FoundationDBClusterReconciler, cluster *fdbv1beta2.FoundationDBCluster, status *fdbv1beta2.FoundationDBStatus, canary *fdbv1beta2.CanaryUpgrade, version fdbv1beta2.Version) ([]*fdbv1beta2.ProcessGroupStatus, *requeue) {
+	selected, err := selectCanaryProcessGroups(cluster, canary)
 	if err != nil {
 		return nil, &requeue{curError: err}
 	}
 
-	if !databaseStatus.Client.DatabaseStatus.Available {
-		r.Recorder.Event(cluster, corev1.EventTypeNormal, "UpgradeRequeued", "Database is unavailable")
-		return nil, &requeue{message: "Deferring upgrade until database is available"}
+	hash := hashProcessGroupIDs(selected)
+	canaryStatus := cluster.Status.CanaryUpgrade
+
+	// A canary from a previous upgrade is only still relevant if it was
+	// started against the version we are upgrading away from right now. If
+	// RunningVersion has moved on since then, this is a new upgrade, even
+	// when it happens to select the same process groups and therefore
+	// produces the same hash; treating it as a continuation would soak
+	// against a SoakStartTime left over from the finished upgrade.
+	if canaryStatus != nil && canaryStatus.FromVersion != cluster.Status.RunningVersion {
+		canaryStatus = nil
 	}
 
-	notReadyProcesses := make([]string, 0)
+	if canaryStatus == nil || canaryStatus.Hash != hash {
+		selectedGroups := processGroupsByID(cluster, selected)
+		cluster.Status.CanaryUpgrade = &fdbv1beta2.CanaryUpgradeStatus{
+			Hash:               hash,
+			FromVersion:        cluster.Status.RunningVersion,
+			ObservedGeneration: cluster.ObjectMeta.Generation,
+		}
+		logger.Info("Starting canary upgrade", "processGroups", selected)
+		r.Recorder.Event(cluster, corev1.EventTypeNormal, "CanaryUpgradeInProgress",
+			fmt.Sprintf("Bouncing canary process groups before the rest of the cluster: %v", selected))
+		return selectedGroups, nil
+	}
+
+	if !canaryAtTargetVersion(status, selected, version) {
+		return processGroupsByID(cluster, selected), &requeue{message: "Waiting for canary process groups to restart at the new version", delayedRequeue: true}
+	}
+
+	if canaryStatus.SoakStartTime == nil {
+		now := time.Now().Unix()
+		cluster.Status.CanaryUpgrade.SoakStartTime = &now
+		return processGroupsByID(cluster, selected), &requeue{message: "Canary processes restarted, beginning soak", delayedRequeue: true}
+	}
+
+	soakDeadline := time.Unix(*canaryStatus.SoakStartTime, 0).Add(canary.SoakDuration.Duration)
+	if time.Now().Before(soakDeadline) {
+		return processGroupsByID(cluster, selected), &requeue{message: "Waiting for the canary soak period to elapse", delay: time.Until(soakDeadline)}
+	}
+
+	if err := evaluateCanarySuccessCriteria(status, canary.SuccessCriteria); err != nil {
+		r.Recorder.Event(cluster, corev1.EventTypeWarning, "CanaryUpgradeFailing", err.Error())
+		return processGroupsByID(cluster, selected), &requeue{message: fmt.Sprintf("Canary upgrade has not met its success criteria: %s", err.Error()), delayedRequeue: true}
+	}
+
+	logger.Info("Canary upgrade succeeded, releasing remaining process groups")
+	r.Recorder.Event(cluster, corev1.EventTypeNormal, "CanaryUpgradeInProgress", "Canary soak succeeded, releasing the remaining process groups for upgrade")
+
+	// The canary has done its job for this upgrade; clear it so a future
+	// upgrade always starts a fresh canary rather than relying on the
+	// FromVersion check above to notice it's stale.
+	cluster.Status.CanaryUpgrade = nil
+
+	return cluster.Status.ProcessGroups, nil
+}
+
+// selectCanaryProcessGroups resolves the CanaryUpgrade.ProcessGroupSelector
+// (explicit IDs, labels, or fault domains) to a concrete, deterministically
+// ordered list of process group IDs.
+func selectCanaryProcessGroups(cluster *fdbv1beta2.FoundationDBCluster, canary *fdbv1beta2.CanaryUpgrade) ([]string, error) {
+	selector := canary.ProcessGroupSelector
+
+	selected := make(map[string]bool)
+	for _, processGroupID := range selector.ProcessGroupIDs {
+		selected[processGroupID] = true
+	}
+
+	for _, processGroup := range cluster.Status.ProcessGroups {
+		if len(selector.FaultDomains) > 0 {
+			for _, faultDomain := range selector.FaultDomains {
+				if string(processGroup.FaultDomain) == faultDomain {
+					selected[processGroup.ProcessGroupID] = true
+				}
+			}
+		}
+
+		if len(selector.MatchLabels) > 0 {
+			matches := true
+			for key, value := range selector.MatchLabels {
+				if processGroup.Labels[key] != value {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				selected[processGroup.ProcessGroupID] = true
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(selected))
+	for processGroupID := range selected {
+		ids = append(ids, processGroupID)
+	}
+	sort.Strings(ids)
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("canary upgrade process group selector did not match any process groups")
+	}
+
+	return ids, nil
+}
+
+// processGroupsByID maps a list of process group IDs back to their
+// ProcessGroupStatus entries in cluster.Status.ProcessGroups.
+func processGroupsByID(cluster *fdbv1beta2.FoundationDBCluster, processGroupIDs []string) []*fdbv1beta2.ProcessGroupStatus {
+	wanted := make(map[string]bool, len(processGroupIDs))
+	for _, processGroupID := range processGroupIDs {
+		wanted[processGroupID] = true
+	}
+
+	groups := make([]*fdbv1beta2.ProcessGroupStatus, 0, len(processGroupIDs))
+	for _, processGroup := range cluster.Status.ProcessGroups {
+		if wanted[processGroup.ProcessGroupID] {
+			groups = append(groups, processGroup)
+		}
+	}
+
+	return groups
+}
+
+// hashProcessGroupIDs returns a stable hash of a (pre-sorted) canary process
+// group selection so the reconciler can tell whether the user changed the
+// canary set and needs to re-canary, as opposed to simply resuming an
+// upgrade that is already in progress.
+func hashProcessGroupIDs(processGroupIDs []string) string {
+	hash := sha256.New()
+	for _, processGroupID := range processGroupIDs {
+		hash.Write([]byte(processGroupID))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// canaryAtTargetVersion returns true once every selected process group is
+// reporting its process at version in the latest database status. A process
+// group that is merely still present in status.Cluster.Processes is not
+// enough — it is present both before and after the canary restarts, so this
+// must check process.Version itself or the soak timer would start before the
+// canary has actually come back up on the new version.
+func canaryAtTargetVersion(status *fdbv1beta2.FoundationDBStatus, selected []string, version fdbv1beta2.Version) bool {
+	wanted := make(map[string]bool, len(selected))
+	for _, processGroupID := range selected {
+		wanted[processGroupID] = true
+	}
+
+	seen := make(map[string]bool, len(selected))
+	for _, process := range status.Cluster.Processes {
+		processID := process.Locality[fdbv1beta2.FDBLocalityInstanceIDKey]
+		if wanted[processID] && process.Version == version.String() {
+			seen[processID] = true
+		}
+	}
+
+	return len(seen) == len(wanted)
+}
+
+// evaluateCanarySuccessCriteria checks the CanaryUpgrade.SuccessCriteria
+// against the latest database status, returning an error describing the
+// first criterion that is not met.
+func evaluateCanarySuccessCriteria(status *fdbv1beta2.FoundationDBStatus, criteria fdbv1beta2.CanarySuccessCriteria) error {
+	if criteria.RequireDatabaseAvailable && !status.Client.DatabaseStatus.Available {
+		return fmt.Errorf("database is unavailable")
+	}
+
+	if criteria.RequireNoRecoveries && status.Cluster.RecoveryState.Name != "" && status.Cluster.RecoveryState.Name != "fully_recovered" {
+		return fmt.Errorf("cluster has an active recovery: %s", status.Cluster.RecoveryState.Name)
+	}
+
+	return nil
+}
+
+// getAddressesForUpgrade returns the addresses of every process that is not
+// yet at the target version. It assumes checkUpgradePreconditions has already
+// confirmed the database is available and every process has acknowledged the
+// pending upgrade; this function only translates that already-validated
+// state into a concrete address list and clears the lock once it has done so.
+func getAddressesForUpgrade(ctx context.Context, lockClient fdbadminclient.LockClient, databaseStatus *fdbv1beta2.FoundationDBStatus, version fdbv1beta2.Version) ([]fdbv1beta2.ProcessAddress, *requeue) {
 	addresses := make([]fdbv1beta2.ProcessAddress, 0, len(databaseStatus.Cluster.Processes))
 	for _, process := range databaseStatus.Cluster.Processes {
-		processID := process.Locality[fdbv1beta2.FDBLocalityInstanceIDKey]
 		if process.Version == version.String() {
 			continue
 		}
-		if pendingUpgrades[processID] {
-			addresses = append(addresses, process.Address)
-		} else {
-			notReadyProcesses = append(notReadyProcesses, processID)
-		}
+		addresses = append(addresses, process.Address)
 	}
 
-	if len(notReadyProcesses) > 0 {
-		logger.Info("Deferring upgrade until all processes are ready to be upgraded", "remainingProcesses", notReadyProcesses)
-		message := fmt.Sprintf("Waiting for processes to be updated: %v", notReadyProcesses)
-		r.Recorder.Event(cluster, corev1.EventTypeNormal, "UpgradeRequeued", message)
-		return nil, &requeue{message: message}
-	}
-	err = lockClient.ClearPendingUpgrades()
-	if err != nil {
+	if err := lockClient.ClearPendingUpgradesWithContext(ctx); err != nil {
 		return nil, &requeue{curError: err}
 	}
 
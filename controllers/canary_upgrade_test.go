@@ -0,0 +1,164 @@
+/*
+ * canary_upgrade_test.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func canaryTestCluster(runningVersion string, canaryStatus *fdbv1beta2.CanaryUpgradeStatus) *fdbv1beta2.FoundationDBCluster {
+	cluster := &fdbv1beta2.FoundationDBCluster{
+		Status: fdbv1beta2.FoundationDBClusterStatus{
+			RunningVersion: runningVersion,
+			CanaryUpgrade:  canaryStatus,
+			ProcessGroups: []*fdbv1beta2.ProcessGroupStatus{
+				{ProcessGroupID: "storage-1"},
+				{ProcessGroupID: "storage-2"},
+			},
+		},
+	}
+	cluster.Spec.AutomationOptions.CanaryUpgrade = &fdbv1beta2.CanaryUpgrade{
+		ProcessGroupSelector: fdbv1beta2.CanaryProcessGroupSelector{
+			ProcessGroupIDs: []string{"storage-1"},
+		},
+		SoakDuration: metav1.Duration{Duration: time.Hour},
+	}
+
+	return cluster
+}
+
+const canaryTestTargetVersion = "6.3.25"
+
+// canaryTestStatus reports the canary's selected process group as already
+// running at version, so canaryProcessGroupsToRelease moves past the
+// "waiting to restart" branch and into the soak-deadline check.
+func canaryTestStatus(version string) *fdbv1beta2.FoundationDBStatus {
+	return &fdbv1beta2.FoundationDBStatus{
+		Cluster: fdbv1beta2.FoundationDBStatusClusterInfo{
+			Processes: map[string]fdbv1beta2.FoundationDBStatusProcessInfo{
+				"storage-1": {
+					Version:  version,
+					Locality: map[string]string{fdbv1beta2.FDBLocalityInstanceIDKey: "storage-1"},
+				},
+			},
+		},
+	}
+}
+
+func TestCanaryAtTargetVersionRequiresMatchingProcessVersion(t *testing.T) {
+	version, err := fdbv1beta2.ParseFdbVersion(canaryTestTargetVersion)
+	if err != nil {
+		t.Fatalf("failed to parse test version: %s", err)
+	}
+
+	if canaryAtTargetVersion(canaryTestStatus("6.3.24"), []string{"storage-1"}, version) {
+		t.Errorf("a process group still reporting the old version must not count as at the target version")
+	}
+
+	if !canaryAtTargetVersion(canaryTestStatus(canaryTestTargetVersion), []string{"storage-1"}, version) {
+		t.Errorf("a process group reporting the target version should count as at the target version")
+	}
+}
+
+func TestCanaryProcessGroupsToReleaseStartsNewCanaryOnHashChange(t *testing.T) {
+	cluster := canaryTestCluster("6.3.24", &fdbv1beta2.CanaryUpgradeStatus{
+		Hash:        "stale-hash",
+		FromVersion: "6.3.24",
+	})
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	version, err := fdbv1beta2.ParseFdbVersion(canaryTestTargetVersion)
+	if err != nil {
+		t.Fatalf("failed to parse test version: %s", err)
+	}
+
+	_, req := canaryProcessGroupsToRelease(logr.Discard(), r, cluster, &fdbv1beta2.FoundationDBStatus{}, cluster.Spec.AutomationOptions.CanaryUpgrade, version)
+	if req != nil {
+		t.Fatalf("expected no requeue so the freshly (re)started canary is registered and bounced, got %+v", req)
+	}
+
+	if cluster.Status.CanaryUpgrade == nil {
+		t.Fatalf("expected CanaryUpgrade status to be set")
+	}
+	if cluster.Status.CanaryUpgrade.Hash == "stale-hash" {
+		t.Errorf("expected a new hash to be recorded, got the stale one")
+	}
+	if cluster.Status.CanaryUpgrade.SoakStartTime != nil {
+		t.Errorf("a newly started canary should not have a SoakStartTime yet")
+	}
+}
+
+func TestCanaryProcessGroupsToReleaseResetsWhenRunningVersionChanges(t *testing.T) {
+	staleSoakStart := int64(1)
+	cluster := canaryTestCluster("6.3.25", &fdbv1beta2.CanaryUpgradeStatus{
+		Hash:          hashProcessGroupIDs([]string{"storage-1"}),
+		FromVersion:   "6.3.24",
+		SoakStartTime: &staleSoakStart,
+	})
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	version, err := fdbv1beta2.ParseFdbVersion(canaryTestTargetVersion)
+	if err != nil {
+		t.Fatalf("failed to parse test version: %s", err)
+	}
+
+	_, req := canaryProcessGroupsToRelease(logr.Discard(), r, cluster, &fdbv1beta2.FoundationDBStatus{}, cluster.Spec.AutomationOptions.CanaryUpgrade, version)
+	if req != nil {
+		t.Fatalf("expected no requeue so the freshly restarted canary is registered and bounced, got %+v", req)
+	}
+
+	if cluster.Status.CanaryUpgrade.FromVersion != "6.3.25" {
+		t.Errorf("expected the stale canary (from a previous RunningVersion) to be replaced, got FromVersion %q", cluster.Status.CanaryUpgrade.FromVersion)
+	}
+	if cluster.Status.CanaryUpgrade.SoakStartTime != nil {
+		t.Errorf("a canary restarted because RunningVersion changed should not reuse the stale SoakStartTime")
+	}
+}
+
+func TestCanaryProcessGroupsToReleaseResumesSameUpgradeWithoutReset(t *testing.T) {
+	soakStart := time.Now().Unix()
+	cluster := canaryTestCluster("6.3.24", &fdbv1beta2.CanaryUpgradeStatus{
+		Hash:          hashProcessGroupIDs([]string{"storage-1"}),
+		FromVersion:   "6.3.24",
+		SoakStartTime: &soakStart,
+	})
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	version, err := fdbv1beta2.ParseFdbVersion(canaryTestTargetVersion)
+	if err != nil {
+		t.Fatalf("failed to parse test version: %s", err)
+	}
+
+	_, req := canaryProcessGroupsToRelease(logr.Discard(), r, cluster, canaryTestStatus(canaryTestTargetVersion), cluster.Spec.AutomationOptions.CanaryUpgrade, version)
+
+	if cluster.Status.CanaryUpgrade == nil || cluster.Status.CanaryUpgrade.SoakStartTime == nil {
+		t.Fatalf("resuming the same upgrade must not clear the in-progress soak")
+	}
+	if *cluster.Status.CanaryUpgrade.SoakStartTime != soakStart {
+		t.Errorf("expected the original SoakStartTime %d to be preserved, got %d", soakStart, *cluster.Status.CanaryUpgrade.SoakStartTime)
+	}
+	if req == nil {
+		t.Fatalf("expected a requeue while the canary is still within its soak window")
+	}
+}
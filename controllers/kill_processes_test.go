@@ -0,0 +1,105 @@
+/*
+ * kill_processes_test.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+	"github.com/FoundationDB/fdb-kubernetes-operator/pkg/fdbadminclient"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeKillAdminClient embeds a nil fdbadminclient.AdminClient so it satisfies
+// the interface without stubbing every method; killProcesses only calls
+// KillProcessesWithContext, which is the one method overridden here.
+type fakeKillAdminClient struct {
+	fdbadminclient.AdminClient
+	killErr error
+}
+
+func (f *fakeKillAdminClient) KillProcessesWithContext(_ context.Context, _ []fdbv1beta2.ProcessAddress) error {
+	return f.killErr
+}
+
+func killProcessesTestReconciler(cluster *fdbv1beta2.FoundationDBCluster) *FoundationDBClusterReconciler {
+	scheme := runtime.NewScheme()
+	_ = fdbv1beta2.AddToScheme(scheme)
+
+	return &FoundationDBClusterReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster).Build(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+}
+
+func killProcessesTestCluster() *fdbv1beta2.FoundationDBCluster {
+	return &fdbv1beta2.FoundationDBCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+	}
+}
+
+func TestKillProcessesRequeuesAndKeepsPendingRestartsOnCancellation(t *testing.T) {
+	cluster := killProcessesTestCluster()
+	r := killProcessesTestReconciler(cluster)
+	addresses := []fdbv1beta2.ProcessAddress{{IPAddress: "storage-1"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	adminClient := &fakeKillAdminClient{killErr: errors.New("rpc error: context canceled")}
+
+	req := killProcesses(ctx, logr.Discard(), r, cluster, adminClient, addresses)
+	if req == nil {
+		t.Fatalf("expected a requeue when the bounce is cancelled")
+	}
+	if req.curError != nil {
+		t.Errorf("a cancelled bounce should requeue for a retry, not surface as a hard error: %s", req.curError)
+	}
+	if !req.delayedRequeue {
+		t.Errorf("expected a delayed requeue so the cancelled bounce is retried rather than hot-looped")
+	}
+
+	if len(cluster.Status.PendingRestarts) != 1 || cluster.Status.PendingRestarts[0].IPAddress != "storage-1" {
+		t.Errorf("PendingRestarts should still list the addresses that were cancelled mid-kill, got %v", cluster.Status.PendingRestarts)
+	}
+}
+
+func TestKillProcessesClearsPendingRestartsOnSuccess(t *testing.T) {
+	cluster := killProcessesTestCluster()
+	r := killProcessesTestReconciler(cluster)
+	addresses := []fdbv1beta2.ProcessAddress{{IPAddress: "storage-1"}}
+
+	adminClient := &fakeKillAdminClient{}
+
+	req := killProcesses(context.Background(), logr.Discard(), r, cluster, adminClient, addresses)
+	if req != nil {
+		t.Fatalf("expected no requeue on a successful kill, got %+v", req)
+	}
+
+	if cluster.Status.PendingRestarts != nil {
+		t.Errorf("PendingRestarts should be cleared once the kill succeeds, got %v", cluster.Status.PendingRestarts)
+	}
+}
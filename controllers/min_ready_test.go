@@ -0,0 +1,156 @@
+/*
+ * min_ready_test.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestProcessGroupAvailableForExcludesRecentlyReadyGroups(t *testing.T) {
+	readyTime := metav1.NewTime(time.Now().Add(-5 * time.Second))
+	processGroup := &fdbv1beta2.ProcessGroupStatus{
+		ProcessGroupID:      "storage-1",
+		LastBecameReadyTime: &readyTime,
+	}
+
+	if processGroupAvailableFor(processGroup, 30) {
+		t.Errorf("a process group ready for only 5s should not be available for a 30s minimum")
+	}
+}
+
+func TestProcessGroupAvailableForIncludesLongReadyGroups(t *testing.T) {
+	readyTime := metav1.NewTime(time.Now().Add(-time.Minute))
+	processGroup := &fdbv1beta2.ProcessGroupStatus{
+		ProcessGroupID:      "storage-1",
+		LastBecameReadyTime: &readyTime,
+	}
+
+	if !processGroupAvailableFor(processGroup, 30) {
+		t.Errorf("a process group ready for 60s should be available for a 30s minimum")
+	}
+}
+
+func TestProcessGroupAvailableForTreatsUnknownReadyTimeAsNotAvailable(t *testing.T) {
+	processGroup := &fdbv1beta2.ProcessGroupStatus{ProcessGroupID: "storage-1"}
+
+	if processGroupAvailableFor(processGroup, 30) {
+		t.Errorf("a process group with no recorded ready time should not be treated as available")
+	}
+}
+
+// minReadyTestFixture builds a cluster with storage process groups that all
+// need a bounce (IncorrectCommandLine): readyLongAgo.len() of them ready well
+// past ProcessMinReadySeconds, and readyRecently.len() of them not. The
+// cluster's ProcessCounts are read back from GetProcessCountsWithDefaults
+// and pinned onto Spec.ProcessCounts so the fixture's process group count is
+// always exactly what the mid-upgrade check expects, regardless of how
+// defaulting computes it -- this test cares about the interaction between
+// that check and ProcessMinReadySeconds, not about replication defaults.
+func minReadyTestFixture(readyLongAgo, readyRecently []metav1.Time) (*fdbv1beta2.FoundationDBCluster, map[string][]fdbv1beta2.ProcessAddress) {
+	cluster := &fdbv1beta2.FoundationDBCluster{
+		Status: fdbv1beta2.FoundationDBClusterStatus{RunningVersion: "6.3.24"},
+	}
+	cluster.Spec.Version = "6.3.25"
+	cluster.Spec.AutomationOptions.ProcessMinReadySeconds = 30
+
+	counts, err := cluster.GetProcessCountsWithDefaults()
+	if err != nil {
+		panic(err)
+	}
+	cluster.Spec.ProcessCounts = counts
+
+	total := len(readyLongAgo) + len(readyRecently)
+	if total != counts.Total() {
+		panic(fmt.Sprintf("test fixture must supply exactly counts.Total() (%d) process groups, got %d", counts.Total(), total))
+	}
+
+	addressMap := make(map[string][]fdbv1beta2.ProcessAddress, total)
+	processGroups := make([]*fdbv1beta2.ProcessGroupStatus, 0, total)
+	addReadyGroup := func(prefix string, index int, readyTime metav1.Time) {
+		id := fmt.Sprintf("%s-%d", prefix, index)
+		processGroups = append(processGroups, &fdbv1beta2.ProcessGroupStatus{
+			ProcessGroupID:      id,
+			ProcessClass:        fdbv1beta2.ProcessClassStorage,
+			LastBecameReadyTime: &readyTime,
+			ProcessGroupConditions: []*fdbv1beta2.ProcessGroupCondition{
+				fdbv1beta2.NewProcessGroupCondition(fdbv1beta2.IncorrectCommandLine),
+			},
+		})
+		addressMap[id] = []fdbv1beta2.ProcessAddress{{IPAddress: id}}
+	}
+	for i, readyTime := range readyLongAgo {
+		addReadyGroup("ready", i, readyTime)
+	}
+	for i, readyTime := range readyRecently {
+		addReadyGroup("not-yet-ready", i, readyTime)
+	}
+
+	cluster.Status.ProcessGroups = processGroups
+
+	return cluster, addressMap
+}
+
+// TestGetProcessesReadyForRestartExcludesOnlyUnreadyGroup exercises the bug
+// fixed two commits ago through the real function: when exactly one process
+// group out of several fails the ProcessMinReadySeconds gate, the other,
+// ready process group must still be returned instead of the whole call
+// returning nil, and the mid-upgrade "expected N processes" count must not
+// be thrown off by the one process group that was deliberately excluded.
+func TestGetProcessesReadyForRestartExcludesOnlyUnreadyGroup(t *testing.T) {
+	readyLongAgo := metav1.NewTime(time.Now().Add(-time.Hour))
+	readyRecently := metav1.NewTime(time.Now())
+	cluster, addressMap := minReadyTestFixture([]metav1.Time{readyLongAgo}, []metav1.Time{readyRecently})
+
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	addresses, req := getProcessesReadyForRestart(logr.Discard(), r, cluster, addressMap, true)
+	if req != nil {
+		t.Fatalf("expected no requeue, got %+v", req)
+	}
+
+	if len(addresses) != 1 || addresses[0].IPAddress != "ready-0" {
+		t.Fatalf("expected only the long-ready process group to be included, got %v", addresses)
+	}
+}
+
+// TestGetProcessesReadyForRestartBlocksWhenNothingIsReady confirms a requeue
+// is still returned when every process group is held back, so the held-back
+// process groups are retried rather than silently dropped.
+func TestGetProcessesReadyForRestartBlocksWhenNothingIsReady(t *testing.T) {
+	justBecameReady := metav1.NewTime(time.Now())
+	cluster, addressMap := minReadyTestFixture(nil, []metav1.Time{justBecameReady, justBecameReady})
+
+	r := &FoundationDBClusterReconciler{Recorder: record.NewFakeRecorder(10)}
+	addresses, req := getProcessesReadyForRestart(logr.Discard(), r, cluster, addressMap, true)
+
+	if len(addresses) != 0 {
+		t.Errorf("expected no addresses to be ready, got %v", addresses)
+	}
+	if req == nil {
+		t.Fatalf("expected a requeue while every process group is held back by ProcessMinReadySeconds")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * upgrade_blocked_test.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// upgradeBlockedTestReconciler returns a reconciler backed by a fake client
+// seeded with cluster, so checkUpgradeBlocked's status update on the paused
+// path has somewhere real to go instead of panicking against a nil client.
+func upgradeBlockedTestReconciler(cluster *fdbv1beta2.FoundationDBCluster) *FoundationDBClusterReconciler {
+	scheme := runtime.NewScheme()
+	_ = fdbv1beta2.AddToScheme(scheme)
+
+	return &FoundationDBClusterReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster).Build(),
+		Recorder: record.NewFakeRecorder(10),
+	}
+}
+
+func upgradeBlockedTestCluster(runningVersion, specVersion string) *fdbv1beta2.FoundationDBCluster {
+	cluster := &fdbv1beta2.FoundationDBCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Status:     fdbv1beta2.FoundationDBClusterStatus{RunningVersion: runningVersion},
+	}
+	cluster.Spec.Version = specVersion
+
+	return cluster
+}
+
+func TestCheckUpgradeBlockedAllowsUpgradeByDefault(t *testing.T) {
+	cluster := upgradeBlockedTestCluster("6.3.24", "6.3.25")
+	r := upgradeBlockedTestReconciler(cluster)
+
+	blocked, err := checkUpgradeBlocked(context.Background(), logr.Discard(), r, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if blocked {
+		t.Errorf("an upgrade with AutoUpgradeEnabled unset and no PreserveDowngradeOption should not be blocked")
+	}
+}
+
+func TestCheckUpgradeBlockedPausesWhenAutoUpgradeDisabled(t *testing.T) {
+	cluster := upgradeBlockedTestCluster("6.3.24", "6.3.25")
+	cluster.Spec.AutomationOptions.AutoUpgradeEnabled = pointer.Bool(false)
+	r := upgradeBlockedTestReconciler(cluster)
+
+	blocked, err := checkUpgradeBlocked(context.Background(), logr.Discard(), r, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !blocked {
+		t.Errorf("an upgrade should be paused while AutoUpgradeEnabled is false")
+	}
+}
+
+func TestCheckUpgradeBlockedPausesOnPreserveDowngradeOption(t *testing.T) {
+	cluster := upgradeBlockedTestCluster("6.3.24", "6.3.25")
+	cluster.Spec.AutomationOptions.PreserveDowngradeOption = "6.3.24"
+	r := upgradeBlockedTestReconciler(cluster)
+
+	blocked, err := checkUpgradeBlocked(context.Background(), logr.Discard(), r, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !blocked {
+		t.Errorf("an upgrade should be paused while PreserveDowngradeOption pins the running version")
+	}
+}
+
+func TestCheckUpgradeBlockedIgnoresPreserveDowngradeOptionForOtherVersions(t *testing.T) {
+	cluster := upgradeBlockedTestCluster("6.3.24", "6.3.25")
+	// PreserveDowngradeOption pins a version other than the one currently
+	// running, so it no longer describes an in-progress downgrade to guard.
+	cluster.Spec.AutomationOptions.PreserveDowngradeOption = "6.3.23"
+	r := upgradeBlockedTestReconciler(cluster)
+
+	blocked, err := checkUpgradeBlocked(context.Background(), logr.Discard(), r, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if blocked {
+		t.Errorf("PreserveDowngradeOption pinning a different version should not pause this upgrade")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * builtin.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package upgradeprecondition
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+)
+
+// DatabaseAvailable blocks the upgrade while the database reports itself as
+// unavailable, mirroring the check that used to live directly in
+// getAddressesForUpgrade.
+type DatabaseAvailable struct{}
+
+// Name implements UpgradePrecondition.
+func (DatabaseAvailable) Name() string {
+	return "DatabaseAvailable"
+}
+
+// Check implements UpgradePrecondition.
+func (DatabaseAvailable) Check(_ context.Context, releaseCtx ReleaseContext) error {
+	if releaseCtx.Status == nil || !releaseCtx.Status.Client.DatabaseStatus.Available {
+		return fmt.Errorf("database is unavailable")
+	}
+
+	return nil
+}
+
+// ConfigMapSynced blocks the upgrade until every process group has picked up
+// the latest dynamic conf ConfigMap, mirroring the allSynced check in
+// getProcessesReadyForRestart, which only applies there when the
+// preconditions are not run.
+type ConfigMapSynced struct{}
+
+// Name implements UpgradePrecondition.
+func (ConfigMapSynced) Name() string {
+	return "ConfigMapSynced"
+}
+
+// Check implements UpgradePrecondition.
+func (ConfigMapSynced) Check(_ context.Context, releaseCtx ReleaseContext) error {
+	for _, processGroup := range releaseCtx.Cluster.Status.ProcessGroups {
+		if processGroup.GetConditionTime(fdbv1beta2.IncorrectConfigMap) != nil {
+			return fmt.Errorf("process group %s is waiting for the dynamic Pod config update", processGroup.ProcessGroupID)
+		}
+	}
+
+	return nil
+}
+
+// MinimumUptime blocks the upgrade until the cluster has been up for at least
+// Cluster.GetMinimumUptimeSecondsForBounce(), mirroring the minimumUptime
+// check in bounceProcesses.reconcile, which only applies there when the
+// preconditions are not run.
+type MinimumUptime struct {
+	// CurrentUptime is the uptime reported for the current reconcile.
+	CurrentUptime float64
+}
+
+// Name implements UpgradePrecondition.
+func (MinimumUptime) Name() string {
+	return "MinimumUptime"
+}
+
+// Check implements UpgradePrecondition.
+func (m MinimumUptime) Check(_ context.Context, releaseCtx ReleaseContext) error {
+	required := float64(releaseCtx.Cluster.GetMinimumUptimeSecondsForBounce())
+	if m.CurrentUptime < required {
+		return fmt.Errorf("cluster has only been up for %f of the required %f seconds", m.CurrentUptime, required)
+	}
+
+	return nil
+}
+
+// PendingUpgradeAcknowledged blocks the upgrade until every process group
+// that is actually being released this reconcile has acknowledged the
+// pending upgrade lock, mirroring the notReadyProcesses check that used to
+// live directly in getAddressesForUpgrade. Outside of a canary upgrade that
+// is every process group in the cluster; during a canary it is only the
+// canary subset, since the rest are deliberately left unregistered until the
+// canary soak succeeds.
+type PendingUpgradeAcknowledged struct {
+	// PendingUpgrades maps process group ID to whether it has acknowledged
+	// the pending upgrade, as returned by LockClient.GetPendingUpgrades.
+	PendingUpgrades map[string]bool
+}
+
+// Name implements UpgradePrecondition.
+func (PendingUpgradeAcknowledged) Name() string {
+	return "PendingUpgradeAcknowledged"
+}
+
+// Check implements UpgradePrecondition.
+func (p PendingUpgradeAcknowledged) Check(_ context.Context, releaseCtx ReleaseContext) error {
+	releasing := make(map[string]bool, len(releaseCtx.ReleaseProcessGroupIDs))
+	for _, processGroupID := range releaseCtx.ReleaseProcessGroupIDs {
+		releasing[processGroupID] = true
+	}
+
+	notReady := make([]string, 0)
+	for _, process := range releaseCtx.Status.Cluster.Processes {
+		processID := process.Locality[fdbv1beta2.FDBLocalityInstanceIDKey]
+		if process.Version == releaseCtx.ToVersion.String() {
+			continue
+		}
+
+		if !releasing[processID] {
+			continue
+		}
+
+		if !p.PendingUpgrades[processID] {
+			notReady = append(notReady, processID)
+		}
+	}
+
+	if len(notReady) > 0 {
+		return fmt.Errorf("processes have not acknowledged the pending upgrade: %v", notReady)
+	}
+
+	return nil
+}
+
+// NoStaleMissingProcesses blocks the upgrade while a process group has been
+// reporting MissingProcesses for longer than
+// Cluster.GetIgnoreMissingProcessesSeconds(). getProcessesReadyForRestart
+// skips such process groups instead of blocking on them.
+type NoStaleMissingProcesses struct{}
+
+// Name implements UpgradePrecondition.
+func (NoStaleMissingProcesses) Name() string {
+	return "NoStaleMissingProcesses"
+}
+
+// Check implements UpgradePrecondition.
+func (NoStaleMissingProcesses) Check(_ context.Context, releaseCtx ReleaseContext) error {
+	threshold := releaseCtx.Cluster.GetIgnoreMissingProcessesSeconds()
+	stale := make([]string, 0)
+	for _, processGroup := range releaseCtx.Cluster.Status.ProcessGroups {
+		missingTime := processGroup.GetConditionTime(fdbv1beta2.MissingProcesses)
+		if missingTime == nil {
+			continue
+		}
+
+		if time.Unix(*missingTime, 0).Add(threshold).Before(time.Now()) {
+			stale = append(stale, processGroup.ProcessGroupID)
+		}
+	}
+
+	if len(stale) > 0 {
+		return fmt.Errorf("process groups have been missing for longer than %s: %v", threshold, stale)
+	}
+
+	return nil
+}
+
+// Defaults returns the built-in preconditions that the reconciler enforces
+// unconditionally, before any cluster-supplied
+// AutomationOptions.UpgradePreconditions are appended.
+func Defaults(currentUptime float64, pendingUpgrades map[string]bool) []UpgradePrecondition {
+	return []UpgradePrecondition{
+		DatabaseAvailable{},
+		ConfigMapSynced{},
+		MinimumUptime{CurrentUptime: currentUptime},
+		PendingUpgradeAcknowledged{PendingUpgrades: pendingUpgrades},
+		NoStaleMissingProcesses{},
+	}
+}
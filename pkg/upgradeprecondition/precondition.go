@@ -0,0 +1,141 @@
+/*
+ * precondition.go
+ *
+ * This source file is part of the FoundationDB open source project
+ *
+ * Copyright 2019-2021 Apple Inc. and the FoundationDB project authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package upgradeprecondition defines the extension point that lets the
+// reconciler and cluster authors gate a version upgrade on a set of checks
+// before any process is killed.
+package upgradeprecondition
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	fdbv1beta2 "github.com/FoundationDB/fdb-kubernetes-operator/api/v1beta2"
+)
+
+// ReleaseContext carries the information an UpgradePrecondition needs to
+// decide whether it is safe to move a cluster from FromVersion to ToVersion.
+type ReleaseContext struct {
+	// FromVersion is the version the cluster is currently running.
+	FromVersion fdbv1beta2.Version
+	// ToVersion is the version the cluster is upgrading to.
+	ToVersion fdbv1beta2.Version
+	// Cluster is the FoundationDBCluster resource being reconciled.
+	Cluster *fdbv1beta2.FoundationDBCluster
+	// Status is the most recently fetched FoundationDB status.
+	Status *fdbv1beta2.FoundationDBStatus
+	// ReleaseProcessGroupIDs lists the process groups that are actually being
+	// registered as pending this upgrade on this reconcile. Outside of a
+	// canary upgrade this is every process group in the cluster; during a
+	// canary it is only the canary subset, so preconditions that reason about
+	// "has this upgrade been acknowledged" must scope themselves to this set
+	// rather than to every process group that isn't at ToVersion yet.
+	ReleaseProcessGroupIDs []string
+}
+
+// UpgradePrecondition is a single named check that must pass before the
+// operator is allowed to bounce processes into a new version. Implementations
+// must be side-effect free: they only observe ReleaseContext and report
+// whether the upgrade may proceed.
+type UpgradePrecondition interface {
+	// Name returns a short, stable identifier for the precondition. It is
+	// used in status conditions and events, so it must not change across
+	// releases of the operator.
+	Name() string
+	// Check returns nil if the precondition is satisfied, or an error
+	// describing why the upgrade must wait otherwise.
+	Check(ctx context.Context, releaseCtx ReleaseContext) error
+}
+
+// Result captures the outcome of running a single UpgradePrecondition.
+type Result struct {
+	// Name is the UpgradePrecondition.Name() that produced this result.
+	Name string
+	// Err is nil if the precondition passed.
+	Err error
+}
+
+// Failed returns true if the precondition did not pass.
+func (r Result) Failed() bool {
+	return r.Err != nil
+}
+
+// RunAll runs every precondition against the same ReleaseContext and returns
+// one Result per precondition, preserving the input order. Preconditions are
+// independent of one another, so a failure in one does not prevent the rest
+// from running; this gives operators a full picture of everything blocking
+// the upgrade in a single reconcile, rather than one error at a time.
+func RunAll(ctx context.Context, preconditions []UpgradePrecondition, releaseCtx ReleaseContext) []Result {
+	results := make([]Result, 0, len(preconditions))
+	for _, precondition := range preconditions {
+		results = append(results, Result{
+			Name: precondition.Name(),
+			Err:  precondition.Check(ctx, releaseCtx),
+		})
+	}
+
+	return results
+}
+
+// Summarize reduces a slice of Results to a single human-readable message
+// listing every failed precondition, or an empty string if all of them
+// passed. This is intended to back a consolidated status condition and event
+// rather than surfacing the first failure in isolation.
+func Summarize(results []Result) string {
+	failures := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.Failed() {
+			failures = append(failures, fmt.Sprintf("%s: %s", result.Name, result.Err.Error()))
+		}
+	}
+
+	if len(failures) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("upgrade preconditions not met: %s", strings.Join(failures, "; "))
+}
+
+// AnyFailed returns true if at least one Result in results failed.
+func AnyFailed(results []Result) bool {
+	for _, result := range results {
+		if result.Failed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FailedNames returns the Name() of every failed precondition in results,
+// preserving input order. This backs the structured status condition the
+// reconciler surfaces on the cluster, so callers can see which preconditions
+// are blocking an upgrade without parsing the summarized event message.
+func FailedNames(results []Result) []string {
+	names := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.Failed() {
+			names = append(names, result.Name)
+		}
+	}
+
+	return names
+}